@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+)
+
+// defaultMaxAttachmentSize is used when SyncOptions.AttachmentMaxSize is zero.
+const defaultMaxAttachmentSize = 25 * 1024 * 1024 // 25 MiB
+
+// extractAttachments parses the message at messagePath and writes each
+// attachment allowed by options to emailDir/attachments/<msgHash>/<filename>.
+func extractAttachments(emailDir, messagePath, msgHash string, options SyncOptions) error {
+	f, err := os.Open(messagePath)
+	if err != nil {
+		return fmt.Errorf("error opening %v for attachment extraction: %v", messagePath, err)
+	}
+	defer f.Close()
+
+	reader, err := mail.CreateReader(f)
+	if err != nil {
+		return fmt.Errorf("error parsing %v for attachment extraction: %v", messagePath, err)
+	}
+
+	maxSize := options.AttachmentMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxAttachmentSize
+	}
+	wordDecoder := &mime.WordDecoder{CharsetReader: charset.Reader}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading part of %v: %v", messagePath, err)
+		}
+
+		header, ok := part.Header.(*mail.AttachmentHeader)
+		if !ok {
+			continue
+		}
+
+		filename, err := header.Filename()
+		if err != nil || filename == "" {
+			continue
+		}
+		if decoded, err := wordDecoder.DecodeHeader(filename); err == nil {
+			filename = decoded
+		}
+
+		contentType, _, _ := header.ContentType()
+		if !attachmentAllowed(contentType, options) {
+			log.Printf("skipping attachment %v (%v) of %v: type not allowed", filename, contentType, messagePath)
+			continue
+		}
+
+		if err := writeAttachment(emailDir, msgHash, filename, part.Body, maxSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAttachment writes a single attachment, skipping (without error) any
+// attachment larger than maxSize.
+func writeAttachment(emailDir, msgHash, filename string, body io.Reader, maxSize int64) error {
+	dir := filepath.Join(emailDir, "attachments", msgHash)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("error creating attachment directory %v: %v", dir, err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("error reading attachment %v: %v", filename, err)
+	}
+	if int64(len(data)) > maxSize {
+		log.Printf("skipping attachment %v in %v: exceeds max size of %d bytes", filename, dir, maxSize)
+		return nil
+	}
+
+	path := filepath.Join(dir, filepath.Base(filename))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("error writing attachment %v: %v", path, err)
+	}
+	return nil
+}
+
+// attachmentAllowed reports whether contentType may be extracted, per
+// options.AttachmentMIMEAllow/AttachmentMIMEDeny. An empty allow list means
+// "allow everything not denied".
+func attachmentAllowed(contentType string, options SyncOptions) bool {
+	for _, denied := range options.AttachmentMIMEDeny {
+		if strings.EqualFold(denied, contentType) {
+			return false
+		}
+	}
+	if len(options.AttachmentMIMEAllow) == 0 {
+		return true
+	}
+	for _, allowed := range options.AttachmentMIMEAllow {
+		if strings.EqualFold(allowed, contentType) {
+			return true
+		}
+	}
+	return false
+}
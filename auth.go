@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-sasl"
+	"github.com/zalando/go-keyring"
+)
+
+// keyringService is the go-keyring service name used when an AccountConfig
+// doesn't specify its own.
+const keyringService = "go-imap-sync"
+
+// Credentials selects how connectWithCredentials authenticates: a plain
+// password (the historical behaviour), or, if OAuth2Token is set, XOAUTH2 SASL
+// instead - the mechanism Gmail and Office 365 require once app passwords are
+// disabled.
+type Credentials struct {
+	Password    string
+	OAuth2Token string
+}
+
+// connectWithCredentials dials server over TLS and logs in as username with
+// creds, supporting OAuth2 in addition to plain password login.
+func connectWithCredentials(server, username string, creds Credentials) (*imapclient.Client, error) {
+	return connectWithHandler(server, username, creds, nil)
+}
+
+// connectWithHandler is connectWithCredentials with an optional
+// UnilateralDataHandler, for use by Watch to learn about mailbox changes that
+// arrive while idling.
+func connectWithHandler(server, username string, creds Credentials, handler *imapclient.UnilateralDataHandler) (*imapclient.Client, error) {
+	options := &imapclient.Options{
+		WordDecoder:           &mime.WordDecoder{CharsetReader: charset.Reader},
+		UnilateralDataHandler: handler,
+	}
+	slog.Debug("Connecting to server", "server", server, "user", username)
+	c, err := imapclient.DialTLS(server, options)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %v: %v", server, err)
+	}
+	if err := c.WaitGreeting(); err != nil {
+		return nil, fmt.Errorf("error waiting for greeting from %v: %v", server, err)
+	}
+	slog.Debug("connected to server, begin login", "server", server, "user", username)
+
+	if creds.OAuth2Token == "" {
+		if err := c.Login(username, creds.Password).Wait(); err != nil {
+			if err2 := c.Logout().Wait(); err2 != nil {
+				return nil, fmt.Errorf("error while logging in to %v: %v\n(logout error: %v)", server, err, err2)
+			}
+			return nil, fmt.Errorf("error while logging in to %v: %v", server, err)
+		}
+		slog.Debug("Logged in as user", "user", username, "server", server)
+		return c, nil
+	}
+
+	saslClient := sasl.NewXOAuth2Client(username, creds.OAuth2Token)
+	if err := c.Authenticate(saslClient); err != nil {
+		if err2 := c.Logout().Wait(); err2 != nil {
+			return nil, fmt.Errorf("error authenticating to %v as %v: %v\n(logout error: %v)", server, username, err, err2)
+		}
+		return nil, fmt.Errorf("error authenticating to %v as %v: %v", server, username, err)
+	}
+	slog.Debug("Logged in as user", "user", username, "server", server)
+	return c, nil
+}
+
+// resolvePassword returns the password to use for account: its own Password if
+// set, otherwise the one stored in the OS keyring under its Keyring service
+// name (or keyringService if Keyring is empty). OAuth2 accounts need no
+// password at all, so resolvePassword returns "" for them.
+func resolvePassword(account AccountConfig) (string, error) {
+	if account.OAuth2 != nil {
+		return "", nil
+	}
+	if account.Password != "" {
+		return account.Password, nil
+	}
+
+	service := account.Keyring
+	if service == "" {
+		service = keyringService
+	}
+	password, err := keyring.Get(service, account.Username)
+	if err != nil {
+		return "", fmt.Errorf("error reading password for %v from keyring %v: %v", account.Username, service, err)
+	}
+	return password, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config describes a multi-account sync configuration loaded from a TOML file,
+// as an alternative to the single-account -server/-username/... flags.
+type Config struct {
+	// MaxConcurrentSyncs bounds how many mailboxes Engine syncs at once across
+	// all accounts. Zero means defaultMaxConcurrentSyncs.
+	MaxConcurrentSyncs int             `toml:"max_concurrent_syncs"`
+	Accounts           []AccountConfig `toml:"account"`
+}
+
+// AccountConfig describes one IMAP account and the mailboxes to sync from it.
+type AccountConfig struct {
+	// Name identifies the account in EngineResult; it defaults to Username.
+	Name     string `toml:"name"`
+	Server   string `toml:"server"`
+	Username string `toml:"username"`
+	// Password is used directly if set. Otherwise, unless OAuth2 is set, the
+	// password is looked up in the OS keyring under Keyring (or the default
+	// service name if Keyring is empty).
+	Password  string          `toml:"password"`
+	Keyring   string          `toml:"keyring"`
+	OAuth2    *OAuth2Config   `toml:"oauth2"`
+	Mailboxes []MailboxConfig `toml:"mailbox"`
+}
+
+// OAuth2Config holds a pre-obtained OAuth2 access token, used for XOAUTH2 SASL
+// authentication instead of a password. This is required by Gmail and Office
+// 365 accounts that have app passwords disabled.
+type OAuth2Config struct {
+	Token string `toml:"token"`
+}
+
+// MailboxConfig describes one mailbox to sync for an account.
+type MailboxConfig struct {
+	Name     string `toml:"name"`
+	EmailDir string `toml:"messages_dir"`
+	// OutputFormat is an OutputFormat value ("eml" or "maildir"); it defaults to
+	// OutputFormatEML.
+	OutputFormat string `toml:"format"`
+}
+
+// LoadConfig reads and parses a multi-account TOML config file.
+func LoadConfig(path string) (*Config, error) {
+	var config Config
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return nil, fmt.Errorf("error reading config %v: %v", path, err)
+	}
+	for i, account := range config.Accounts {
+		if account.Name == "" {
+			config.Accounts[i].Name = account.Username
+		}
+	}
+	return &config, nil
+}
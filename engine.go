@@ -0,0 +1,90 @@
+package main
+
+import "sync"
+
+// defaultMaxConcurrentSyncs is used when a Config doesn't set
+// MaxConcurrentSyncs.
+const defaultMaxConcurrentSyncs = 4
+
+// Engine runs Sync concurrently across every mailbox of every account in a
+// Config, bounded by a worker pool so a large config file doesn't open an
+// unbounded number of IMAP connections at once.
+type Engine struct {
+	config *Config
+}
+
+// NewEngine creates an Engine for the given config.
+func NewEngine(config *Config) *Engine {
+	return &Engine{config: config}
+}
+
+// EngineResult is the outcome of syncing one account's mailbox.
+type EngineResult struct {
+	Account string
+	Mailbox string
+	Result  *Result
+	Err     error
+}
+
+// syncJob is one account/mailbox pair to sync.
+type syncJob struct {
+	account AccountConfig
+	mailbox MailboxConfig
+}
+
+// Run syncs every mailbox of every account in the config concurrently, using at
+// most config.MaxConcurrentSyncs workers, and returns one EngineResult per
+// account/mailbox (in no particular order).
+func (e *Engine) Run() []EngineResult {
+	var jobs []syncJob
+	for _, account := range e.config.Accounts {
+		for _, mailbox := range account.Mailboxes {
+			jobs = append(jobs, syncJob{account: account, mailbox: mailbox})
+		}
+	}
+
+	maxConcurrent := e.config.MaxConcurrentSyncs
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentSyncs
+	}
+
+	results := make([]EngineResult, len(jobs))
+	sem := make(chan struct{}, maxConcurrent)
+	var wg sync.WaitGroup
+
+	for i, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, job syncJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = runSyncJob(job)
+		}(i, job)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// runSyncJob resolves job's password/keyring/OAuth2 credentials and runs Sync
+// for it.
+func runSyncJob(job syncJob) EngineResult {
+	result := EngineResult{Account: job.account.Name, Mailbox: job.mailbox.Name}
+
+	password, err := resolvePassword(job.account)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	options := SyncOptions{OutputFormat: OutputFormat(job.mailbox.OutputFormat)}
+	if options.OutputFormat == "" {
+		options.OutputFormat = OutputFormatEML
+	}
+	if job.account.OAuth2 != nil {
+		options.OAuth2Token = job.account.OAuth2.Token
+	}
+
+	result.Result, result.Err = Sync(job.account.Server, job.account.Username, password, job.mailbox.Name, job.mailbox.EmailDir, options)
+	return result
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// mailboxStateFile is the name of the per-mailbox incremental sync state file,
+// stored at the root of emailDir (next to, not inside, the maildir's own
+// tmp/new/cur subdirectories).
+const mailboxStateFile = ".mailbox-state.json"
+
+// mailboxState is the incremental sync watermark for one mailbox, persisted so
+// that a later Sync can fetch only what changed instead of re-checking every
+// message. UIDValidity must match the server's current value for LastUID and
+// HighestModSeq to still be meaningful; a mismatch means the mailbox was
+// recreated and forces a full resync.
+type mailboxState struct {
+	UIDValidity   uint32 `json:"uidValidity"`
+	HighestModSeq uint64 `json:"highestModSeq"`
+	LastUID       uint32 `json:"lastUid"`
+}
+
+// readMailboxState loads the incremental sync state for emailDir, if any.
+func readMailboxState(emailDir string) (*mailboxState, bool, error) {
+	data, err := os.ReadFile(filepath.Join(emailDir, mailboxStateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("error reading mailbox state: %v", err)
+	}
+
+	var state mailboxState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, false, fmt.Errorf("error parsing mailbox state: %v", err)
+	}
+	return &state, true, nil
+}
+
+// writeMailboxState persists the incremental sync state for emailDir.
+func writeMailboxState(emailDir string, state mailboxState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding mailbox state: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(emailDir, mailboxStateFile), data, 0o600); err != nil {
+		return fmt.Errorf("error writing mailbox state: %v", err)
+	}
+	return nil
+}
+
+// indexLocalStatesByUID returns the message path for each UID recorded in
+// emailDir's per-message state files.
+func indexLocalStatesByUID(emailDir string) (map[uint32]string, error) {
+	states, err := collectLocalStates(emailDir)
+	if err != nil {
+		return nil, err
+	}
+	byUID := make(map[uint32]string, len(states))
+	for path, state := range states {
+		byUID[state.UID] = path
+	}
+	return byUID, nil
+}
+
+// refreshFlags fetches only the flags (no bodies) of the messages in numSet
+// that changed since changedSince, and applies those changes to the
+// already-downloaded messages they belong to. It is used to pick up flag
+// changes (e.g. read elsewhere) on an otherwise incremental sync, which only
+// fetches new UIDs; passing changedSince keeps this O(changed) instead of
+// O(numSet) by relying on the CONDSTORE CHANGEDSINCE FETCH modifier (RFC 4551)
+// so the server itself filters out everything unchanged.
+func refreshFlags(connection *imapclient.Client, emailDir string, options SyncOptions, numSet imap.NumSet, changedSince imap.ModSeq) error {
+	byUID, err := indexLocalStatesByUID(emailDir)
+	if err != nil {
+		return err
+	}
+	if len(byUID) == 0 {
+		return nil
+	}
+
+	fetchCmd := connection.Fetch(numSet, &imap.FetchOptions{UID: true, Flags: true, ChangedSince: changedSince})
+	defer fetchCmd.Close()
+
+	for {
+		msg := fetchCmd.Next()
+		if msg == nil {
+			break
+		}
+
+		var uid uint32
+		var flags []imap.Flag
+		for {
+			item := msg.Next()
+			if item == nil {
+				break
+			}
+			switch item := item.(type) {
+			case imapclient.FetchItemDataUID:
+				uid = uint32(item.UID)
+			case imapclient.FetchItemDataFlags:
+				flags = item.Flags
+			}
+		}
+
+		path, ok := byUID[uid]
+		if !ok {
+			continue
+		}
+		if err := applyRefreshedFlags(emailDir, path, options, uid, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRefreshedFlags updates the local copy of an already-downloaded message to
+// match flags reported by the server, without touching its body.
+func applyRefreshedFlags(emailDir, path string, options SyncOptions, uid uint32, flags []imap.Flag) error {
+	state, found, err := readMessageState(path)
+	if err != nil {
+		return err
+	}
+	if !found || flagsEqual(stringsToFlags(state.Flags), flags) {
+		return nil
+	}
+
+	newPath := path
+	if options.OutputFormat == OutputFormatMaildir {
+		unique := sha512TruncatedHex(state.MessageID)
+		updated, err := updateMaildirFlags(emailDir, path, unique, flags)
+		if err != nil {
+			return err
+		}
+		newPath = updated
+		if newPath != path {
+			if err := os.Rename(stateFileName(path), stateFileName(newPath)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error moving state for %v: %v", path, err)
+			}
+		}
+	}
+
+	state.UID = uid
+	state.Flags = flagsToStrings(flags)
+	return writeMessageState(newPath, *state)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// maildirFlagLetters maps IMAP flags to their Maildir "info" letter, see
+// https://cr.yp.to/proto/maildir.html.
+var maildirFlagLetters = map[imap.Flag]byte{
+	imap.FlagSeen:     'S',
+	imap.FlagAnswered: 'R',
+	imap.FlagFlagged:  'F',
+	imap.FlagDeleted:  'T',
+	imap.FlagDraft:    'D',
+}
+
+// maildirInfo renders IMAP flags as the sorted Maildir info string (e.g. "FS" for
+// \Flagged \Seen), as required by the "unique:2,FLAGS" filename convention.
+func maildirInfo(flags []imap.Flag) string {
+	letters := make([]byte, 0, len(flags))
+	for _, flag := range flags {
+		if letter, ok := maildirFlagLetters[flag]; ok {
+			letters = append(letters, letter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return string(letters)
+}
+
+// maildirInfoToFlags is the inverse of maildirInfo: it recovers the IMAP flags
+// encoded in a Maildir info string, so local flag changes can be detected from a
+// message's filename alone.
+func maildirInfoToFlags(info string) []imap.Flag {
+	flagsByLetter := make(map[byte]imap.Flag, len(maildirFlagLetters))
+	for flag, letter := range maildirFlagLetters {
+		flagsByLetter[letter] = flag
+	}
+
+	flags := make([]imap.Flag, 0, len(info))
+	for i := 0; i < len(info); i++ {
+		if flag, ok := flagsByLetter[info[i]]; ok {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// ensureMaildir creates the tmp, new and cur subdirectories of emailDir, as
+// required before any message can be written in Maildir format.
+func ensureMaildir(emailDir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(emailDir, sub), 0o700); err != nil {
+			return fmt.Errorf("error creating maildir directory %v: %v", sub, err)
+		}
+	}
+	return nil
+}
+
+// findMaildirMessage looks for a previously written message with the given unique
+// name in the new/ and cur/ subdirectories of emailDir, regardless of its current
+// flag suffix. It returns the matching path, or found=false if none exists.
+func findMaildirMessage(emailDir, unique string) (path string, found bool, err error) {
+	for _, sub := range []string{"new", "cur"} {
+		dir := filepath.Join(emailDir, sub)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", false, fmt.Errorf("error reading maildir directory %v: %v", dir, err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if name == unique || strings.HasPrefix(name, unique+":2,") {
+				return filepath.Join(dir, name), true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// maildirFileName builds the filename used for a message with the given unique
+// name and flags, per the Maildir spec: a bare "unique" name for new/ (reserved
+// for genuinely flag-less mail), or "unique:2,FLAGS" for cur/ otherwise - so an
+// unseen but \Flagged or \Answered message still carries its flags in the name.
+func maildirFileName(unique string, flags []imap.Flag) string {
+	if len(flags) == 0 {
+		return unique
+	}
+	return fmt.Sprintf("%s:2,%s", unique, maildirInfo(flags))
+}
+
+// maildirTargetDir returns the new/ or cur/ subdirectory a message with the given
+// flags belongs in: flag-less mail goes to new/, any flagged message to cur/.
+func maildirTargetDir(emailDir string, flags []imap.Flag) string {
+	if len(flags) == 0 {
+		return filepath.Join(emailDir, "new")
+	}
+	return filepath.Join(emailDir, "cur")
+}
+
+// updateMaildirFlags moves an already-downloaded message between new/ and cur/ and
+// rewrites its flag suffix if the flags reported by the server have changed, without
+// touching the message body.
+func updateMaildirFlags(emailDir, currentPath, unique string, flags []imap.Flag) (string, error) {
+	target := filepath.Join(maildirTargetDir(emailDir, flags), maildirFileName(unique, flags))
+	if target == currentPath {
+		return currentPath, nil
+	}
+	if err := os.Rename(currentPath, target); err != nil {
+		return "", fmt.Errorf("error updating maildir flags for %v: %v", currentPath, err)
+	}
+	return target, nil
+}
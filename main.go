@@ -9,7 +9,9 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/emersion/go-imap/v2"
 	"github.com/howeyc/gopass"
 )
 
@@ -28,19 +30,23 @@ func getPassword(username, server string) (password string) {
 }
 
 func main() {
-	var server, username, mailbox, emailDir string
+	var server, username, mailbox, emailDir, format, search, since, from, configPath string
+	var unseen, watch bool
+	var pollInterval time.Duration
+	flag.StringVar(&configPath, "config", "", "path to a TOML config file describing multiple accounts; supersedes -server/-username/-mailbox/-messagesDir/-format")
 	flag.StringVar(&server, "server", "", "sync from this mail server and port (e.g. mail.example.com:993)")
 	flag.StringVar(&username, "username", "", "username for logging into the mail server")
 	flag.StringVar(&mailbox, "mailbox", "", "mailbox to read messages from (typically INBOX or INBOX/subfolder)")
 	flag.StringVar(&emailDir, "messagesDir", "messages", "local directory to save messages in")
+	flag.StringVar(&format, "format", string(OutputFormatEML), "output format: eml (flat .eml files) or maildir")
+	flag.StringVar(&search, "search", "", "only sync messages whose body or headers contain this text")
+	flag.StringVar(&since, "since", "", "only sync messages received since this date (YYYY-MM-DD)")
+	flag.StringVar(&from, "from", "", "only sync messages sent from this address")
+	flag.BoolVar(&unseen, "unseen", false, "only sync messages that are not marked as \\Seen")
+	flag.BoolVar(&watch, "watch", false, "keep running after the initial sync, reacting to new/changed messages via IMAP IDLE (for use as a systemd service)")
+	flag.DurationVar(&pollInterval, "pollInterval", defaultPollInterval, "with -watch, how often to re-sync when the server does not support IDLE")
 	flag.Parse()
 
-	if server == "" {
-		log.Println("go-imap-sync copies emails from an IMAP mailbox to your computer. Usage:")
-		flag.PrintDefaults()
-		log.Fatal("Required parameters not found.")
-	}
-
 	// set slog text global logger
 	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level:     slog.LevelDebug,
@@ -57,10 +63,91 @@ func main() {
 	})
 	slog.SetDefault(slog.New(handler))
 
+	if configPath != "" {
+		runWithConfig(configPath)
+		return
+	}
+
+	if server == "" {
+		log.Println("go-imap-sync copies emails from an IMAP mailbox to your computer. Usage:")
+		flag.PrintDefaults()
+		log.Fatal("Required parameters not found.")
+	}
+
+	outputFormat := OutputFormat(format)
+	if outputFormat != OutputFormatEML && outputFormat != OutputFormatMaildir {
+		log.Fatalf("unknown -format %q, must be %q or %q", format, OutputFormatEML, OutputFormatMaildir)
+	}
+
+	criteria, err := buildSearchCriteria(search, since, from, unseen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	password := getPassword(username, server)
+	options := SyncOptions{OutputFormat: outputFormat, SearchCriteria: criteria}
 
-	_, err := Sync(server, username, password, mailbox, emailDir)
+	if watch {
+		if err := Watch(server, username, password, mailbox, emailDir, options, pollInterval); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if _, err := Sync(server, username, password, mailbox, emailDir, options); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runWithConfig loads a multi-account config file and syncs every account's
+// mailboxes concurrently via Engine, exiting with a non-zero status if any
+// mailbox failed to sync.
+func runWithConfig(configPath string) {
+	config, err := LoadConfig(configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	results := NewEngine(config).Run()
+
+	failed := false
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("error syncing %v/%v: %v", result.Account, result.Mailbox, result.Err)
+			failed = true
+			continue
+		}
+		log.Printf("synced %v/%v: %d new, %d existing", result.Account, result.Mailbox, len(result.Result.NewEmails), len(result.Result.ExistingEmails))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// buildSearchCriteria compiles the -search/-since/-from/-unseen flags into an
+// imap.SearchCriteria, or returns nil if none of them were given.
+func buildSearchCriteria(search, since, from string, unseen bool) (*imap.SearchCriteria, error) {
+	if search == "" && since == "" && from == "" && !unseen {
+		return nil, nil
+	}
+
+	var criteria imap.SearchCriteria
+	if search != "" {
+		criteria.Text = []string{search}
+	}
+	if since != "" {
+		sinceTime, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -since date %q, want YYYY-MM-DD: %v", since, err)
+		}
+		criteria.Since = sinceTime
+	}
+	if from != "" {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeaderField{Key: "From", Value: from})
+	}
+	if unseen {
+		criteria.NotFlag = append(criteria.NotFlag, imap.FlagSeen)
+	}
+	return &criteria, nil
 }
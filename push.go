@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// defaultTrashMailbox is used by Push when options.TrashMailbox is empty.
+const defaultTrashMailbox = "Trash"
+
+// PushResult summarizes the local changes Push replayed to the server.
+type PushResult struct {
+	FlagsUpdated []string
+	Deleted      []string
+}
+
+// Push scans emailDir for local changes recorded via each message's sidecar state
+// file (see messageState) and replays them to the IMAP server: flag changes via
+// STORE, and messages removed locally via MOVE (RFC 6851) to options.TrashMailbox,
+// falling back to COPY+STORE \Deleted+EXPUNGE when the server lacks the MOVE
+// capability. In SyncModeTwoWay, a flag change is only pushed if the server's
+// flags have not diverged from the last sync; a divergence is resolved with
+// options.ConflictPolicy instead.
+func Push(server, user, password, mailbox, emailDir string, options SyncOptions) (*PushResult, error) {
+	trashMailbox := options.TrashMailbox
+	if trashMailbox == "" {
+		trashMailbox = defaultTrashMailbox
+	}
+
+	connection, err := connectWithCredentials(server, user, Credentials{Password: password, OAuth2Token: options.OAuth2Token})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := connection.Logout().Wait(); err != nil {
+			slog.Error("error on logout from server", "server", server, "user", user, "error", err)
+		}
+	}()
+
+	if _, err := connection.Select(mailbox, &imap.SelectOptions{}).Wait(); err != nil {
+		return nil, fmt.Errorf("error selecting mailbox %v: %v", mailbox, err)
+	}
+	canMove := connection.Caps().Has(imap.CapMove)
+	canUIDPlus := connection.Caps().Has(imap.CapUIDPlus)
+
+	states, err := collectLocalStates(emailDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result PushResult
+	for messagePath, state := range states {
+		exists, err := fileExists(messagePath)
+		if err != nil {
+			return nil, err
+		}
+		if !exists && options.OutputFormat == OutputFormatMaildir {
+			// A mail client records a flag change by renaming the message, so
+			// look for it under its current name before treating it as deleted.
+			current, found, err := findMaildirMessage(emailDir, sha512TruncatedHex(state.MessageID))
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				if err := os.Rename(stateFileName(messagePath), stateFileName(current)); err != nil {
+					return nil, fmt.Errorf("error moving state for %v: %v", messagePath, err)
+				}
+				messagePath, exists = current, true
+			}
+		}
+
+		if !exists {
+			if err := removeOnServer(connection, canMove, canUIDPlus, trashMailbox, state.UID); err != nil {
+				return nil, fmt.Errorf("error removing message %v (uid %v) on server: %v", messagePath, state.UID, err)
+			}
+			if err := os.Remove(stateFileName(messagePath)); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("error removing state for %v: %v", messagePath, err)
+			}
+			result.Deleted = append(result.Deleted, messagePath)
+			continue
+		}
+
+		localFlags := localFlagsOf(messagePath, options)
+		if localFlags == nil || flagsEqual(localFlags, stringsToFlags(state.Flags)) {
+			continue
+		}
+
+		if options.Mode == SyncModeTwoWay {
+			serverFlags, found, err := fetchFlags(connection, state.UID)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching current flags for uid %v: %v", state.UID, err)
+			}
+			if !found {
+				log.Printf("skipping flag push for %v: uid %v no longer exists on server", messagePath, state.UID)
+				continue
+			}
+			if !flagsEqual(serverFlags, stringsToFlags(state.Flags)) {
+				winner := resolveConflict(options.ConflictPolicy, messagePath, localFlags)
+				if winner == nil {
+					if err := pullServerFlags(messagePath, options, state, serverFlags); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				localFlags = winner
+			}
+		}
+
+		if err := storeFlags(connection, state.UID, localFlags); err != nil {
+			return nil, fmt.Errorf("error updating flags for %v (uid %v): %v", messagePath, state.UID, err)
+		}
+		state.Flags = flagsToStrings(localFlags)
+		if err := writeMessageState(messagePath, *state); err != nil {
+			return nil, err
+		}
+		result.FlagsUpdated = append(result.FlagsUpdated, messagePath)
+	}
+
+	log.Printf("Finished pushing.")
+	return &result, nil
+}
+
+// collectLocalStates walks emailDir for message state files and returns the
+// decoded state for each, keyed by the message's own path.
+func collectLocalStates(emailDir string) (map[string]*messageState, error) {
+	states := make(map[string]*messageState)
+	err := filepath.WalkDir(emailDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".state.json") {
+			return nil
+		}
+
+		messagePath := strings.TrimSuffix(path, ".state.json")
+		state, found, err := readMessageState(messagePath)
+		if err != nil {
+			return err
+		}
+		if found {
+			states[messagePath] = state
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %v for local state: %v", emailDir, err)
+	}
+	return states, nil
+}
+
+// localFlagsOf returns the flags currently encoded in messagePath's own name, or
+// nil if the output format does not encode flags locally (plain .eml files).
+// A maildir name with no ":2," suffix is a bare new/ name (unseen mail, no
+// flags at all), which is distinct from "not maildir" and so returns an empty,
+// non-nil slice rather than nil.
+func localFlagsOf(messagePath string, options SyncOptions) []imap.Flag {
+	if options.OutputFormat != OutputFormatMaildir {
+		return nil
+	}
+	name := filepath.Base(messagePath)
+	idx := strings.Index(name, ":2,")
+	if idx < 0 {
+		return []imap.Flag{}
+	}
+	return maildirInfoToFlags(name[idx+len(":2,"):])
+}
+
+// resolveConflict decides whether to push localFlags or let the server's flags
+// stand. It returns nil to mean "server wins".
+func resolveConflict(policy ConflictPolicy, messagePath string, localFlags []imap.Flag) []imap.Flag {
+	switch policy {
+	case ConflictLocalWins:
+		return localFlags
+	case ConflictNewest:
+		messageInfo, err1 := os.Stat(messagePath)
+		stateInfo, err2 := os.Stat(stateFileName(messagePath))
+		if err1 == nil && err2 == nil && messageInfo.ModTime().After(stateInfo.ModTime()) {
+			return localFlags
+		}
+		return nil
+	default: // ConflictServerWins
+		return nil
+	}
+}
+
+// pullServerFlags updates messagePath (moving it between new/ and cur/ for
+// Maildir) and its state to match the server's flags, without pushing anything.
+func pullServerFlags(messagePath string, options SyncOptions, state *messageState, serverFlags []imap.Flag) error {
+	newPath := messagePath
+	if options.OutputFormat == OutputFormatMaildir {
+		unique := sha512TruncatedHex(state.MessageID)
+		updated, err := updateMaildirFlags(filepath.Dir(filepath.Dir(messagePath)), messagePath, unique, serverFlags)
+		if err != nil {
+			return err
+		}
+		newPath = updated
+	}
+	if newPath != messagePath {
+		if err := os.Rename(stateFileName(messagePath), stateFileName(newPath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error moving state for %v: %v", messagePath, err)
+		}
+	}
+	state.Flags = flagsToStrings(serverFlags)
+	return writeMessageState(newPath, *state)
+}
+
+// fetchFlags fetches the current flags of the message with the given UID.
+// found is false, with no error, if the UID no longer exists on the server
+// (e.g. it was deleted there since the last sync) - that is a normal outcome
+// for the caller to resolve locally, not a failure of the fetch itself.
+func fetchFlags(connection *imapclient.Client, uid uint32) (flags []imap.Flag, found bool, err error) {
+	numSet := imap.UIDSetNum(imap.UID(uid))
+	fetchCmd := connection.Fetch(numSet, &imap.FetchOptions{Flags: true})
+	defer fetchCmd.Close()
+
+	msg := fetchCmd.Next()
+	if msg == nil {
+		return nil, false, nil
+	}
+
+	for {
+		item := msg.Next()
+		if item == nil {
+			break
+		}
+		if flagsItem, ok := item.(imapclient.FetchItemDataFlags); ok {
+			flags = flagsItem.Flags
+		}
+	}
+	return flags, true, nil
+}
+
+// storeFlags replaces the flags of the message with the given UID.
+func storeFlags(connection *imapclient.Client, uid uint32, flags []imap.Flag) error {
+	numSet := imap.UIDSetNum(imap.UID(uid))
+	storeFlags := &imap.StoreFlags{Op: imap.StoreFlagsSet, Flags: flags}
+	return connection.Store(numSet, storeFlags, nil).Close()
+}
+
+// removeOnServer replays a local deletion to the server by moving the message
+// with the given UID into trashMailbox, using MOVE when available and falling
+// back to COPY+STORE \Deleted+(UID )EXPUNGE otherwise. The EXPUNGE is scoped to
+// uid alone via UIDPLUS (RFC 4315) when the server supports it; servers that
+// don't get a mailbox-wide EXPUNGE instead, which also purges any other
+// message already flagged \Deleted, so that fallback logs a warning.
+func removeOnServer(connection *imapclient.Client, canMove, canUIDPlus bool, trashMailbox string, uid uint32) error {
+	numSet := imap.UIDSetNum(imap.UID(uid))
+
+	if canMove {
+		if _, err := connection.Move(numSet, trashMailbox).Wait(); err != nil {
+			return fmt.Errorf("error moving message to %v: %v", trashMailbox, err)
+		}
+		return nil
+	}
+
+	if _, err := connection.Copy(numSet, trashMailbox).Wait(); err != nil {
+		return fmt.Errorf("error copying message to %v: %v", trashMailbox, err)
+	}
+	deletedFlag := &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagDeleted}}
+	if err := connection.Store(numSet, deletedFlag, nil).Close(); err != nil {
+		return fmt.Errorf("error marking message deleted: %v", err)
+	}
+
+	if canUIDPlus {
+		if err := connection.UIDExpunge(numSet).Close(); err != nil {
+			return fmt.Errorf("error expunging message uid %v: %v", uid, err)
+		}
+		return nil
+	}
+
+	slog.Warn("server lacks UIDPLUS, falling back to a mailbox-wide EXPUNGE; this will also purge any other message flagged \\Deleted", "uid", uid)
+	if err := connection.Expunge().Close(); err != nil {
+		return fmt.Errorf("error expunging mailbox: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// messageNumSet returns the set of messages Sync should fetch: the UIDs matching
+// criteria if given, or every message in the currently selected mailbox
+// otherwise. Searching is UID-based so the result set stays valid even if
+// messages are expunged while fetching.
+func messageNumSet(connection *imapclient.Client, criteria *imap.SearchCriteria, numMessages uint32) (imap.NumSet, error) {
+	if criteria == nil {
+		if numMessages == 0 {
+			return imap.SeqSet{}, nil
+		}
+		var seqSet imap.SeqSet
+		seqSet.AddRange(1, numMessages)
+		return seqSet, nil
+	}
+
+	// UIDSearch transparently uses the ESEARCH extension (RFC 4731) when the
+	// server advertises it, which matters for mailboxes with many matches.
+	searchCmd := connection.UIDSearch(criteria, nil)
+	searchData, err := searchCmd.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("error searching mailbox: %v", err)
+	}
+	return imap.UIDSetNum(searchData.AllUIDs()...), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// messageState is the per-message sync state persisted alongside each downloaded
+// message, recording enough of the server's view of that message (UID, mailbox,
+// flags) that Push can later detect local changes and, in SyncModeTwoWay, server
+// divergence, without re-fetching the whole mailbox.
+type messageState struct {
+	UID       uint32   `json:"uid"`
+	MessageID string   `json:"messageId"`
+	Mailbox   string   `json:"mailbox"`
+	Flags     []string `json:"flags"`
+}
+
+// stateFileName returns the sidecar state file path for a downloaded message.
+func stateFileName(messagePath string) string {
+	return messagePath + ".state.json"
+}
+
+// readMessageState loads the sidecar state for messagePath, if any.
+func readMessageState(messagePath string) (*messageState, bool, error) {
+	data, err := os.ReadFile(stateFileName(messagePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("error reading state for %v: %v", messagePath, err)
+	}
+
+	var state messageState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, false, fmt.Errorf("error parsing state for %v: %v", messagePath, err)
+	}
+	return &state, true, nil
+}
+
+// writeMessageState persists the sidecar state for messagePath.
+func writeMessageState(messagePath string, state messageState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state for %v: %v", messagePath, err)
+	}
+	if err := os.WriteFile(stateFileName(messagePath), data, 0o600); err != nil {
+		return fmt.Errorf("error writing state for %v: %v", messagePath, err)
+	}
+	return nil
+}
+
+// flagsToStrings converts IMAP flags to their string form for storage in a
+// messageState.
+func flagsToStrings(flags []imap.Flag) []string {
+	strs := make([]string, len(flags))
+	for i, flag := range flags {
+		strs[i] = string(flag)
+	}
+	return strs
+}
+
+// stringsToFlags is the inverse of flagsToStrings.
+func stringsToFlags(strs []string) []imap.Flag {
+	flags := make([]imap.Flag, len(strs))
+	for i, s := range strs {
+		flags[i] = imap.Flag(s)
+	}
+	return flags
+}
+
+// flagsEqual reports whether a and b contain the same set of flags, ignoring order.
+func flagsEqual(a, b []imap.Flag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[imap.Flag]int, len(a))
+	for _, flag := range a {
+		counts[flag]++
+	}
+	for _, flag := range b {
+		counts[flag]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
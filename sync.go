@@ -11,60 +11,112 @@ import (
 	"io"
 	"log"
 	"log/slog"
-	"mime"
 	"os"
 	"path/filepath"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
-	client "github.com/emersion/go-imap/v2/imapclient"
-	"github.com/emersion/go-message/charset"
 )
 
 // Result contains slices of (relative) paths to the newly (NewEmails) and previously downloaded emails (ExistingEmails).
-// Only emails still present on the server will be returned.
+// On a full sync, both are only emails still present on the server. On an
+// incremental sync (see the comment above Sync's "incremental" variable),
+// ExistingEmails is instead populated from each previously downloaded
+// message's local state without re-checking the server, since an incremental
+// sync only fetches the UID range above the last watermark rather than
+// listing the mailbox; a message deleted server-side may still be reported
+// until a full resync (there is no QRESYNC VANISHED handling yet) notices it's
+// gone.
 type Result struct {
 	ExistingEmails []string
 	NewEmails      []string
 }
 
-// connect performs an interactive connection to the given IMAP server
-func connect(server, username, password string) (*client.Client, error) {
-	options := &imapclient.Options{
-		WordDecoder: &mime.WordDecoder{CharsetReader: charset.Reader},
-	}
-	slog.Debug("Connecting to server", "server", server, "user", username)
-	c, err := client.DialTLS(server, options)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to %v: %v", server, err)
-	}
-	slog.Debug("connected to server, begin login", "server", server, "user", username)
+// OutputFormat selects how Sync lays out downloaded messages on disk.
+type OutputFormat string
 
-	err = c.WaitGreeting()
-	if err != nil {
-		return nil, fmt.Errorf("error waiting for greeting from %v: %v", server, err)
-	}
-	slog.Debug("greeting received")
+const (
+	// OutputFormatEML writes each message as a flat "<hash>.eml" file (the original,
+	// default layout).
+	OutputFormatEML OutputFormat = "eml"
+	// OutputFormatMaildir writes each message into a Maildir (tmp/new/cur) with the
+	// standard "unique:2,FLAGS" filename convention, so the result can be read
+	// directly by mutt, notmuch and similar tools.
+	OutputFormatMaildir OutputFormat = "maildir"
+)
 
-	if err := c.Login(username, password).Wait(); err != nil {
-		if err2 := c.Logout().Wait(); err2 != nil {
-			return nil, fmt.Errorf("error while logging in to %v: %v\n(logout error: %v)", server, err, err2)
-		}
-		return nil, fmt.Errorf("error while logging in to %v: %v", server, err)
-	}
-	slog.Debug("Logged in as user", "user", username, "server", server)
-	return c, nil
+// SyncMode selects the direction messages flow in. Sync always pulls regardless
+// of Mode; Mode instead controls Push's behaviour, in particular how
+// SyncModeTwoWay resolves conflicts against ConflictPolicy.
+type SyncMode string
+
+const (
+	// SyncModePull only downloads messages from the server (Sync's own behaviour).
+	SyncModePull SyncMode = "pull"
+	// SyncModePush replays local changes to the server without considering
+	// whether the server has changed in the meantime.
+	SyncModePush SyncMode = "push"
+	// SyncModeTwoWay replays local changes to the server, but first checks
+	// whether the server's flags have diverged since the last sync and applies
+	// ConflictPolicy when they have.
+	SyncModeTwoWay SyncMode = "twoway"
+)
+
+// ConflictPolicy decides which side wins when SyncModeTwoWay finds a message
+// that changed both locally and on the server since the last sync.
+type ConflictPolicy string
+
+const (
+	// ConflictServerWins discards the local change and pulls the server's flags
+	// down instead. This is the zero value.
+	ConflictServerWins ConflictPolicy = "server-wins"
+	// ConflictLocalWins always pushes the local change, overwriting the server.
+	ConflictLocalWins ConflictPolicy = "local-wins"
+	// ConflictNewest approximates which side changed more recently using the
+	// local message file's mtime versus its last recorded sync time, and keeps
+	// that side's flags.
+	ConflictNewest ConflictPolicy = "newest"
+)
+
+// SyncOptions controls optional Sync and Push behaviour. The zero value is
+// equivalent to the historical Sync behaviour (flat .eml files, pull only).
+type SyncOptions struct {
+	OutputFormat   OutputFormat
+	Mode           SyncMode
+	ConflictPolicy ConflictPolicy
+	// TrashMailbox is the mailbox Push moves locally deleted messages into. It
+	// defaults to "Trash" when empty.
+	TrashMailbox string
+	// SearchCriteria, if set, restricts Sync to messages matching it instead of
+	// the whole mailbox.
+	SearchCriteria *imap.SearchCriteria
+	// OAuth2Token, if set, authenticates via XOAUTH2 SASL using this access
+	// token instead of the password argument.
+	OAuth2Token string
+	// ExtractAttachments, if true, additionally decodes each newly downloaded
+	// message and writes its attachments under emailDir/attachments/<msgHash>/.
+	ExtractAttachments bool
+	// AttachmentMIMEAllow, if non-empty, restricts extraction to these MIME
+	// types (e.g. "application/pdf"); AttachmentMIMEDeny always takes priority.
+	AttachmentMIMEAllow []string
+	AttachmentMIMEDeny  []string
+	// AttachmentMaxSize caps how large a single attachment may be before it is
+	// skipped. Zero means defaultMaxAttachmentSize.
+	AttachmentMaxSize int64
 }
 
 // Sync downloads and saves all not-yet downloaded emails from the mailbox to the emailDir
-func Sync(server, user, password, mailbox, emailDir string) (*Result, error) {
-	err := os.MkdirAll(emailDir, 0o700)
-	if err != nil {
+func Sync(server, user, password, mailbox, emailDir string, options SyncOptions) (*Result, error) {
+	if options.OutputFormat == OutputFormatMaildir {
+		if err := ensureMaildir(emailDir); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(emailDir, 0o700); err != nil {
 		return nil, fmt.Errorf("error creating email directory %v: %v", emailDir, err)
 	}
 
 	slog.Debug("Connecting to server", "server", server, "user", user)
-	connection, err := connect(server, user, password)
+	connection, err := connectWithCredentials(server, user, Credentials{Password: password, OAuth2Token: options.OAuth2Token})
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +128,12 @@ func Sync(server, user, password, mailbox, emailDir string) (*Result, error) {
 		}
 	}()
 
-	selectCmd := connection.Select(mailbox, &imap.SelectOptions{})
+	selectOptions := &imap.SelectOptions{}
+	condStore := connection.Caps().Has(imap.CapCondStore) || connection.Caps().Has(imap.CapQResync)
+	if condStore {
+		selectOptions.CondStore = true
+	}
+	selectCmd := connection.Select(mailbox, selectOptions)
 
 	selectData, err := selectCmd.Wait()
 	if err != nil {
@@ -84,17 +141,85 @@ func Sync(server, user, password, mailbox, emailDir string) (*Result, error) {
 	}
 	slog.Debug("selected mailbox", "mailbox", mailbox, "numMessages", selectData.NumMessages, "selectData", selectData)
 
+	// Resume an incremental sync by fetching only UIDs above the last one we saw,
+	// as long as the mailbox hasn't been recreated (UIDVALIDITY changed) and we
+	// are not doing a one-off search. This avoids the O(N) per-message check a
+	// full scan requires even when nothing changed. Note this has no QRESYNC
+	// VANISHED handling: a message removed on the server between runs is not
+	// noticed until its absence causes a UIDVALIDITY-forced (or otherwise) full
+	// resync, so it keeps being reported in ExistingEmails until then.
+	mbState, hasMbState, err := readMailboxState(emailDir)
+	if err != nil {
+		return nil, err
+	}
+	incremental := options.SearchCriteria == nil && hasMbState && mbState.UIDValidity == selectData.UIDValidity
+
+	var numSet imap.NumSet
+	var flagRefreshSet imap.NumSet
+	var flagRefreshSince imap.ModSeq
+	maxUID := uint32(0)
+	var result Result
+	if incremental {
+		slog.Debug("resuming incremental sync", "mailbox", mailbox, "lastUID", mbState.LastUID, "highestModSeq", mbState.HighestModSeq)
+		maxUID = mbState.LastUID
+		numSet = imap.UIDSet{imap.UIDRange{Start: imap.UID(mbState.LastUID + 1), Stop: 0}}
+
+		// Without CONDSTORE we have no HighestModSeq to compare, and thus no cheap
+		// way to tell whether anything changed, so always do a full (no
+		// CHANGEDSINCE) flag scan; with it, only bother when the mailbox's modseq
+		// actually moved, and let CHANGEDSINCE do the filtering server-side.
+		if mbState.LastUID > 0 {
+			if !condStore || selectData.HighestModSeq != mbState.HighestModSeq {
+				flagRefreshSet = imap.UIDSet{imap.UIDRange{Start: 1, Stop: imap.UID(mbState.LastUID)}}
+				if condStore {
+					flagRefreshSince = imap.ModSeq(mbState.HighestModSeq)
+				}
+			}
+		}
+
+		byUID, err := indexLocalStatesByUID(emailDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range byUID {
+			result.ExistingEmails = append(result.ExistingEmails, path)
+		}
+	} else {
+		if hasMbState && options.SearchCriteria == nil {
+			slog.Debug("mailbox UIDVALIDITY changed, forcing full resync", "mailbox", mailbox)
+		}
+		numSet, err = messageNumSet(connection, options.SearchCriteria, selectData.NumMessages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if flagRefreshSet != nil {
+		if err := refreshFlags(connection, emailDir, options, flagRefreshSet, flagRefreshSince); err != nil {
+			return nil, err
+		}
+	}
+
+	// Collected after refreshFlags, which may rename Maildir messages.
+	if incremental {
+		byUID, err := indexLocalStatesByUID(emailDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range byUID {
+			result.ExistingEmails = append(result.ExistingEmails, path)
+		}
+	}
+
 	// Send a FETCH command to fetch the message body
-	seqSet := imap.SeqSetNum(1)
 	fetchOptions := &imap.FetchOptions{
 		UID:         true,
 		Envelope:    true,
+		Flags:       true,
 		BodySection: []*imap.FetchItemBodySection{{}},
 	}
-	fetchCmd := connection.Fetch(seqSet, fetchOptions)
+	fetchCmd := connection.Fetch(numSet, fetchOptions)
 	defer fetchCmd.Close()
-
-	var result Result
 	// a map of sequence numbers to email MessageID
 	seqNumMessageIDMap := make(map[uint32]string)
 	// see https://pkg.go.dev/github.com/emersion/go-imap/v2/imapclient#example-Client.Fetch-StreamBody
@@ -119,6 +244,7 @@ func Sync(server, user, password, mailbox, emailDir string) (*Result, error) {
 		// Find the uid, envelope, body section in the response
 		var uid uint32
 		var envelope *imap.Envelope
+		var flags []imap.Flag
 		var bodySection imapclient.FetchItemDataBodySection
 		for {
 			item := msg.Next()
@@ -134,6 +260,8 @@ func Sync(server, user, password, mailbox, emailDir string) (*Result, error) {
 			case imapclient.FetchItemDataEnvelope:
 				log.Printf("Envelope MessageID: %v", item.Envelope.MessageID)
 				envelope = item.Envelope
+			case imapclient.FetchItemDataFlags:
+				flags = item.Flags
 			case imapclient.FetchItemDataBodySection:
 				bodySection = item
 			}
@@ -143,33 +271,44 @@ func Sync(server, user, password, mailbox, emailDir string) (*Result, error) {
 				seqNumMessageIDMap[uid] = envelope.MessageID
 
 				slog.Debug("have all data we need", "seq", msg.SeqNum, "uid", uid,
-					"messageID", envelope.MessageID, "subject", envelope.Subject)
+					"messageID", envelope.MessageID, "subject", envelope.Subject, "flags", flags)
 
-				exists, err := fileExists(messageFileName(emailDir, envelope.MessageID))
+				path, isNew, err := storeMessage(emailDir, options, uid, envelope.MessageID, mailbox, flags, bodySection.Literal)
 				if err != nil {
 					log.Fatal(err)
 				}
-				if exists {
-					result.ExistingEmails = append(result.ExistingEmails, messageFileName(emailDir, envelope.MessageID))
-				} else {
-					result.NewEmails = append(result.NewEmails, messageFileName(emailDir, envelope.MessageID))
-					log.Printf("Writing message %v to %v", envelope.MessageID, messageFileName(emailDir, envelope.MessageID))
-
-					body, err := io.ReadAll(bodySection.Literal)
-					if err != nil {
-						log.Fatalf("failed to read body section: %v", err)
-					}
-					slog.Debug("Body", "body", string(body))
-					err = os.WriteFile(messageFileName(emailDir, envelope.MessageID), body, 0o600)
-					if err != nil {
-						log.Fatalf("failed to write body to file: %v", err)
+				if isNew {
+					result.NewEmails = append(result.NewEmails, path)
+					if options.ExtractAttachments {
+						msgHash := sha512TruncatedHex(envelope.MessageID)
+						if err := extractAttachments(emailDir, path, msgHash, options); err != nil {
+							return nil, err
+						}
 					}
+				} else {
+					result.ExistingEmails = append(result.ExistingEmails, path)
+				}
+				if uid > maxUID {
+					maxUID = uid
 				}
 				break
 			}
 		}
 	}
 
+	// A search-restricted sync only sees a subset of the mailbox, so its UID
+	// watermark must not overwrite the one an unfiltered sync relies on.
+	if options.SearchCriteria == nil {
+		newState := mailboxState{
+			UIDValidity:   selectData.UIDValidity,
+			HighestModSeq: selectData.HighestModSeq,
+			LastUID:       maxUID,
+		}
+		if err := writeMailboxState(emailDir, newState); err != nil {
+			return nil, err
+		}
+	}
+
 	log.Printf("Finished syncing.")
 
 	return &result, nil
@@ -190,6 +329,102 @@ func messageFileName(emailDir, messageID string) string {
 	return filepath.Join(emailDir, fmt.Sprintf("%s.eml", sha512TruncatedHex(messageID)))
 }
 
+// streamToFile copies body to path without buffering it fully in memory, so a
+// multi-GB message doesn't OOM the process.
+func streamToFile(path string, body io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating %v: %v", path, err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write body to file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing %v: %v", path, err)
+	}
+	return nil
+}
+
+// storeMessage writes (or, for an already downloaded message, updates) the message
+// identified by messageID according to options.OutputFormat, reading its body from
+// body only if it has not been downloaded yet. It also records the message's UID,
+// mailbox and flags in a sidecar state file, so Push can later detect local changes.
+// It returns the path the message was stored at and whether it was newly downloaded.
+func storeMessage(emailDir string, options SyncOptions, uid uint32, messageID, mailbox string, flags []imap.Flag, body io.Reader) (string, bool, error) {
+	if options.OutputFormat == OutputFormatMaildir {
+		return storeMaildirMessage(emailDir, uid, messageID, mailbox, flags, body)
+	}
+
+	path := messageFileName(emailDir, messageID)
+	exists, err := fileExists(path)
+	if err != nil {
+		return "", false, err
+	}
+	isNew := !exists
+	if isNew {
+		log.Printf("Writing message %v to %v", messageID, path)
+		partial := path + ".partial"
+		if err := streamToFile(partial, body); err != nil {
+			return "", false, err
+		}
+		if err := os.Rename(partial, path); err != nil {
+			return "", false, fmt.Errorf("error moving %v into place: %v", partial, err)
+		}
+	}
+
+	state := messageState{UID: uid, MessageID: messageID, Mailbox: mailbox, Flags: flagsToStrings(flags)}
+	if err := writeMessageState(path, state); err != nil {
+		return "", false, err
+	}
+	return path, isNew, nil
+}
+
+// storeMaildirMessage writes a message in Maildir format, placing flag-less mail
+// in new/ and any message with flags (even an unseen one) in cur/, as
+// maildirTargetDir decides. If the message was already downloaded, its flag
+// suffix (and new/cur location) is updated to match the server without
+// re-fetching the body.
+func storeMaildirMessage(emailDir string, uid uint32, messageID, mailbox string, flags []imap.Flag, body io.Reader) (string, bool, error) {
+	unique := sha512TruncatedHex(messageID)
+
+	existingPath, found, err := findMaildirMessage(emailDir, unique)
+	if err != nil {
+		return "", false, err
+	}
+
+	var path string
+	if found {
+		path, err = updateMaildirFlags(emailDir, existingPath, unique, flags)
+		if err != nil {
+			return "", false, err
+		}
+		if path != existingPath {
+			if err := os.Rename(stateFileName(existingPath), stateFileName(path)); err != nil && !os.IsNotExist(err) {
+				return "", false, fmt.Errorf("error moving state for %v: %v", existingPath, err)
+			}
+		}
+	} else {
+		tmpPath := filepath.Join(emailDir, "tmp", unique)
+		if err := streamToFile(tmpPath, body); err != nil {
+			return "", false, err
+		}
+
+		path = filepath.Join(maildirTargetDir(emailDir, flags), maildirFileName(unique, flags))
+		log.Printf("Writing message %v to %v", messageID, path)
+		if err := os.Rename(tmpPath, path); err != nil {
+			return "", false, fmt.Errorf("error moving message into place at %v: %v", path, err)
+		}
+	}
+
+	state := messageState{UID: uid, MessageID: messageID, Mailbox: mailbox, Flags: flagsToStrings(flags)}
+	if err := writeMessageState(path, state); err != nil {
+		return "", false, err
+	}
+	return path, !found, nil
+}
+
 // fileExists checks if the given path exists and can be Stat'd.
 func fileExists(path string) (bool, error) {
 	_, err := os.Stat(path)
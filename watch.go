@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// idleRefreshInterval bounds how long a single IDLE command is kept open.
+// RFC 2177 recommends re-issuing IDLE every 29 minutes at most, since some
+// servers drop the connection after 30 minutes of inactivity.
+const idleRefreshInterval = 29 * time.Minute
+
+// defaultPollInterval is used by Watch when the server does not advertise
+// the IDLE capability.
+const defaultPollInterval = 2 * time.Minute
+
+// minWatchBackoff and maxWatchBackoff bound the exponential backoff Watch
+// applies between reconnect attempts after a network error.
+const (
+	minWatchBackoff = 5 * time.Second
+	maxWatchBackoff = 5 * time.Minute
+)
+
+// Watch runs Sync once and then keeps emailDir continuously up to date: if the
+// server advertises the IDLE capability (RFC 2177), it issues IDLE and, on
+// waking (because the server announced new or changed messages, because
+// idleRefreshInterval elapsed, or because pollInterval elapsed with no IDLE
+// support), runs Sync again. Unless options.SearchCriteria is set (which makes
+// every Sync a full one), Sync resumes from the last UID, so each of these
+// wake-ups only fetches the bodies of new messages, not the whole mailbox;
+// flags of known messages are refreshed only where the server reports a change
+// if it supports CONDSTORE, and all of them otherwise.
+// pollInterval is used in place of IDLE when the server doesn't support it; a
+// value of zero means defaultPollInterval. Watch only returns (with an error)
+// if the initial Sync fails; afterwards it logs and reconnects with
+// exponential backoff instead of giving up.
+func Watch(server, user, password, mailbox, emailDir string, options SyncOptions, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	if _, err := Sync(server, user, password, mailbox, emailDir, options); err != nil {
+		return fmt.Errorf("error during initial sync: %v", err)
+	}
+
+	backoff := minWatchBackoff
+	resetBackoff := func() { backoff = minWatchBackoff }
+	for {
+		err := watchOnce(server, user, password, mailbox, emailDir, options, pollInterval, resetBackoff)
+		if err == nil {
+			continue
+		}
+		slog.Error("watch session ended, reconnecting", "server", server, "mailbox", mailbox, "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// watchOnce holds a single IMAP connection open, blocking until either a
+// network error occurs (in which case it returns that error so Watch can
+// reconnect with backoff) or the process is otherwise interrupted. On
+// success (the mailbox selected for IDLE, or a polling Sync completed) it
+// resets Watch's backoff by calling resetBackoff.
+func watchOnce(server, user, password, mailbox, emailDir string, options SyncOptions, pollInterval time.Duration, resetBackoff func()) error {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := &imapclient.UnilateralDataHandler{
+		Expunge: func(seqNum uint32) { notify() },
+		Mailbox: func(data *imapclient.UnilateralDataMailbox) { notify() },
+		Fetch:   func(msg *imapclient.FetchMessageData) { notify() },
+	}
+
+	connection, err := connectWithHandler(server, user, Credentials{Password: password, OAuth2Token: options.OAuth2Token}, handler)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := connection.Logout().Wait(); err != nil {
+			slog.Error("error on logout from server", "server", server, "user", user, "error", err)
+		}
+	}()
+
+	if !connection.Caps().Has(imap.CapIdle) {
+		slog.Info("server does not support IDLE, falling back to polling", "server", server, "mailbox", mailbox, "interval", pollInterval)
+		for {
+			time.Sleep(pollInterval)
+			if _, err := Sync(server, user, password, mailbox, emailDir, options); err != nil {
+				return err
+			}
+			resetBackoff()
+		}
+	}
+
+	if _, err := connection.Select(mailbox, &imap.SelectOptions{}).Wait(); err != nil {
+		return fmt.Errorf("error selecting mailbox %v: %v", mailbox, err)
+	}
+	resetBackoff()
+
+	for {
+		idleCmd, err := connection.Idle()
+		if err != nil {
+			return fmt.Errorf("error starting IDLE: %v", err)
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(idleRefreshInterval):
+		}
+
+		if err := idleCmd.Close(); err != nil {
+			return fmt.Errorf("error stopping IDLE: %v", err)
+		}
+
+		if _, err := Sync(server, user, password, mailbox, emailDir, options); err != nil {
+			return err
+		}
+	}
+}